@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/gempir/go-twitch-irc"
+	"github.com/zmb3/spotify"
+)
+
+// firstArtistName returns the name of the first credited artist, or
+// "unknown artist" for tracks with no artist credit (e.g. some podcast
+// episodes and local files).
+func firstArtistName(artists []spotify.SimpleArtist) string {
+	if len(artists) == 0 {
+		return "unknown artist"
+	}
+	return artists[0].Name
+}
+
+// CommandContext carries everything a CommandHandler needs to know about
+// the message that triggered it.
+type CommandContext struct {
+	Channel string
+	User    twitch.User
+	Args    string
+}
+
+// CommandHandler handles a chat command and returns the chat message to
+// reply with, or "" to say nothing.
+type CommandHandler func(ctx *CommandContext) (string, error)
+
+// commands maps a chat trigger to its handler. New commands are added here
+// instead of growing the OnNewMessage closure in handleTwitchMessages.
+var commands = map[string]CommandHandler{
+	"!sinnaybot song": handleSongCommand,
+	"!songlink":       handleSongLinkCommand,
+	"!album":          handleAlbumCommand,
+	"!queue":          handleQueueCommand,
+	"!sr":             handleSongRequestCommand,
+}
+
+// dispatchCommand looks up the command triggered by text and, if it's not
+// on cooldown for this user+channel, runs it and says the reply.
+func dispatchCommand(client *twitch.Client, channel string, user twitch.User, text string) {
+	lowered := strings.ToLower(text)
+
+	for trigger, handler := range commands {
+		if !strings.HasPrefix(lowered, trigger) {
+			continue
+		}
+
+		if !cooldowns.Allow(trigger, channel, user.Username) {
+			return
+		}
+
+		ctx := &CommandContext{
+			Channel: channel,
+			User:    user,
+			Args:    strings.TrimSpace(text[len(trigger):]),
+		}
+
+		reply, err := handler(ctx)
+		if err != nil {
+			log.Printf("command %q failed: %s", trigger, err)
+			return
+		}
+
+		if reply != "" {
+			client.Say(channel, reply)
+		}
+		return
+	}
+}
+
+func handleSongCommand(ctx *CommandContext) (string, error) {
+	track, err := getCurrentlyPlayingTrack(ctx.Channel)
+	if err != nil {
+		return "", err
+	}
+
+	if track.Item == nil {
+		return fmt.Sprintf("@%s, no song currently playing", ctx.User.Username), nil
+	}
+
+	return fmt.Sprintf("@%s, the song currently playing is %s by %s", ctx.User.Username, track.Item.Name, firstArtistName(track.Item.Artists)), nil
+}
+
+func handleSongLinkCommand(ctx *CommandContext) (string, error) {
+	track, err := getCurrentlyPlayingTrack(ctx.Channel)
+	if err != nil {
+		return "", err
+	}
+
+	if track.Item == nil {
+		return fmt.Sprintf("@%s, no song currently playing", ctx.User.Username), nil
+	}
+
+	link, ok := track.Item.ExternalURLs["spotify"]
+	if !ok {
+		return fmt.Sprintf("@%s, no Spotify link available for this track", ctx.User.Username), nil
+	}
+
+	return fmt.Sprintf("@%s, %s", ctx.User.Username, link), nil
+}
+
+func handleAlbumCommand(ctx *CommandContext) (string, error) {
+	track, err := getCurrentlyPlayingTrack(ctx.Channel)
+	if err != nil {
+		return "", err
+	}
+
+	if track.Item == nil {
+		return fmt.Sprintf("@%s, no song currently playing", ctx.User.Username), nil
+	}
+
+	album := track.Item.Album
+	year := album.ReleaseDate
+	if len(year) >= 4 {
+		year = year[:4]
+	}
+
+	return fmt.Sprintf("@%s, %s is from the album %s (%s)", ctx.User.Username, track.Item.Name, album.Name, year), nil
+}
+
+func handleQueueCommand(ctx *CommandContext) (string, error) {
+	const maxTracks = 3
+
+	tracks, err := getUpcomingQueue(ctx.Channel, maxTracks)
+	if err != nil {
+		return "", err
+	}
+
+	if len(tracks) == 0 {
+		return fmt.Sprintf("@%s, the queue is empty", ctx.User.Username), nil
+	}
+
+	names := make([]string, len(tracks))
+	for i, track := range tracks {
+		names[i] = fmt.Sprintf("%s by %s", track.Name, firstArtistName(track.Artists))
+	}
+
+	return fmt.Sprintf("@%s, up next: %s", ctx.User.Username, strings.Join(names, "; ")), nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CooldownTracker rate-limits chat commands per command+channel+user so a
+// single viewer spamming !song (or everyone piling on at once) can't flood
+// chat.
+type CooldownTracker struct {
+	mu       sync.Mutex
+	last     map[string]time.Time
+	duration time.Duration
+}
+
+func NewCooldownTracker(duration time.Duration) *CooldownTracker {
+	return &CooldownTracker{
+		last:     make(map[string]time.Time),
+		duration: duration,
+	}
+}
+
+// Allow reports whether command may run for user in channel right now, and
+// if so starts its cooldown.
+func (c *CooldownTracker) Allow(command, channel, user string) bool {
+	key := command + "|" + channel + "|" + user
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if last, ok := c.last[key]; ok && time.Since(last) < c.duration {
+		return false
+	}
+
+	c.last[key] = time.Now()
+	return true
+}
+
+// cooldowns gates every registered chat command. The cooldown length is
+// configurable via COMMAND_COOLDOWN_SECONDS, defaulting to 10 seconds.
+var cooldowns = NewCooldownTracker(commandCooldownDuration())
+
+func commandCooldownDuration() time.Duration {
+	const defaultSeconds = 10
+
+	seconds := defaultSeconds
+	if v := os.Getenv("COMMAND_COOLDOWN_SECONDS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			seconds = n
+		}
+	}
+
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// healthState tracks the liveness signals surfaced at /healthz.
+type healthState struct {
+	mu              sync.RWMutex
+	twitchConnected bool
+	lastSpotifyPoll time.Time
+}
+
+// health is the process-wide liveness tracker, updated by the Twitch IRC
+// supervisor and every successful Spotify poll.
+var health = &healthState{}
+
+func (h *healthState) setTwitchConnected(connected bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.twitchConnected = connected
+}
+
+func (h *healthState) recordSpotifyPoll(at time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastSpotifyPoll = at
+}
+
+// snapshot reports the current health of the bot for broadcastChannel.
+func (h *healthState) snapshot(broadcastChannel string) map[string]interface{} {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return map[string]interface{}{
+		"spotify_authenticated":    channelAuthCompleted(broadcastChannel),
+		"twitch_irc_connected":     h.twitchConnected,
+		"last_spotify_poll_at":     h.lastSpotifyPoll,
+		"last_spotify_poll_age_ms": sinceOrZero(h.lastSpotifyPoll),
+	}
+}
+
+func sinceOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return time.Since(t).Milliseconds()
+}
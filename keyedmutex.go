@@ -0,0 +1,33 @@
+package main
+
+import "sync"
+
+// KeyedMutex hands out a lock per string key, so unrelated keys never block
+// each other while operations on the same key are fully serialized.
+type KeyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func NewKeyedMutex() *KeyedMutex {
+	return &KeyedMutex{locks: make(map[string]*sync.Mutex)}
+}
+
+// LockByKey locks the mutex for key and returns a function that unlocks it.
+func (k *KeyedMutex) LockByKey(key string) func() {
+	k.mu.Lock()
+	lock, ok := k.locks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		k.locks[key] = lock
+	}
+	k.mu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// locker serializes Spotify token refresh+persist sequences per channel, so
+// two concurrent !song calls for the same broadcaster can't both refresh the
+// same (single-use) refresh token and race each other out of auth.
+var locker = NewKeyedMutex()
@@ -1,20 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/gempir/go-twitch-irc"
 	"github.com/gin-gonic/gin"
 	"github.com/zmb3/spotify"
+	"golang.org/x/oauth2"
 )
 
 var (
@@ -31,12 +34,10 @@ type TwitchChannel struct {
 	Handle string `json:"broadcaster_login"`
 }
 
-type SpotifyClient struct {
-	client spotify.Client
-	mu     sync.Mutex
-}
-
-var spotifyClient SpotifyClient
+// tokenStore holds one Spotify OAuth token per broadcaster channel, so the
+// bot can serve !song for multiple channels and survive restarts without
+// re-authenticating. It's initialized in main().
+var tokenStore TokenStore
 
 var (
 	twitchClientID         = os.Getenv("TWITCH_CLIENT_ID")     // Get from env or just paste here
@@ -44,7 +45,6 @@ var (
 	twitchRedirectURI      = os.Getenv("TWITCH_REDIRECT_URL")  // Replace with your Twitch Client Secret
 	twitchBotUsername      = os.Getenv("TWITCH_BOT_USERNAME")
 	twitchBroadcastChannel = os.Getenv("TWITCH_BROADCAST_CHANNEL")
-	spotifyAuthCompleted   = false
 	spotifyNeedsAuthHTML   = `<!DOCTYPE html>
 <html>
 	<head>
@@ -52,109 +52,338 @@ var (
 	</head>
 	<body>
 		<h3>Spotify not authenticated</h3>
-		<p>You need to <a href='http://localhost:8080/spotify/login'>authenticate with spotify</a> before requesting this page .</p>
+		<p>You need to <a href='http://localhost:8080/spotify/login?channel=%s'>authenticate with spotify</a> before requesting this page .</p>
 	</body>
 </html>`
 )
 
 func main() {
+	checkSpotifyCredentials()
+
+	store, err := NewFileTokenStore(tokenStoreDir())
+	if err != nil {
+		log.Fatalf("Failed to initialize token store: %s", err)
+	}
+	tokenStore = store
+
+	if cfg, err := LoadSongRequestConfig(songRequestConfigPath()); err != nil {
+		log.Printf("No song request config loaded, using defaults: %s", err)
+	} else {
+		songRequestConfig = cfg
+	}
+
 	r := gin.Default()
 
 	r.GET("/twitch/login", func(c *gin.Context) {
-		if !spotifyAuthCompleted {
-			c.HTML(200, "text/html", spotifyNeedsAuthHTML)
+		if !channelAuthCompleted(twitchBroadcastChannel) {
+			c.HTML(200, "text/html", fmt.Sprintf(spotifyNeedsAuthHTML, twitchBroadcastChannel))
+			return
 		}
 		url := getTwitchAuthURL()
 		c.Redirect(http.StatusTemporaryRedirect, url)
 	})
 
 	r.GET("/twitch/callback", func(c *gin.Context) {
-		if !spotifyAuthCompleted {
-			c.HTML(200, "text/html", spotifyNeedsAuthHTML)
+		if !channelAuthCompleted(twitchBroadcastChannel) {
+			c.HTML(200, "text/html", fmt.Sprintf(spotifyNeedsAuthHTML, twitchBroadcastChannel))
+			return
 		}
 
 		code := c.Query("code")
 		accessToken, err := getTwitchAccessToken(code)
 		if err != nil {
-			log.Fatal(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
 		}
-		handleTwitchMessages(accessToken)
-		c.String(http.StatusOK, "Successfully posted message to Twitch channel!")
+		go superviseTwitchBot(accessToken)
+		c.String(http.StatusOK, "Connecting to Twitch channel!")
 	})
 
-	// Spotify authorization flow
+	// Spotify authorization flow. Each broadcaster authenticates separately,
+	// identified by the `channel` query param, which is threaded through as
+	// the OAuth state so /spotify/callback knows which channel to save the
+	// resulting token under.
 	r.GET("/spotify/login", func(c *gin.Context) {
-		auth := spotifyAuth()
-		url := auth.AuthURL("state")
+		channel := c.Query("channel")
+		if channel == "" {
+			c.String(http.StatusBadRequest, "Missing required query param: channel")
+			return
+		}
+
+		auth, err := spotifyAuth()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Spotify is misconfigured: %s", err)})
+			return
+		}
+		url := auth.AuthURL(channel)
 		c.Redirect(http.StatusTemporaryRedirect, url)
 	})
 
 	r.GET("/spotify/callback", func(c *gin.Context) {
-		auth := spotifyAuth()
+		channel := c.Query("state")
+		if channel == "" {
+			c.String(http.StatusBadRequest, "Missing state param, don't know which channel to authenticate")
+			return
+		}
 
-		token, err := auth.Token("state", c.Request)
+		auth, err := spotifyAuth()
 		if err != nil {
-			log.Fatal(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Spotify is misconfigured: %s", err)})
+			return
 		}
 
-		spotifyClient.mu.Lock()
-		defer spotifyClient.mu.Unlock()
+		token, err := auth.Token(channel, c.Request)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Spotify authentication failed: %s", err)})
+			return
+		}
 
-		spotifyClient.client = auth.NewClient(token)
-		if spotifyClient.client != (spotify.Client{}) {
-			spotifyAuthCompleted = true
+		if err := tokenStore.SaveToken(channel, token); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to persist Spotify token: %s", err)})
+			return
 		}
 
-		c.String(http.StatusOK, "Successfully authenticated with Spotify!")
+		c.String(http.StatusOK, "Successfully authenticated %s with Spotify!", channel)
 	})
 
 	r.GET("/spotify/current", func(c *gin.Context) {
+		channel := c.DefaultQuery("channel", twitchBroadcastChannel)
 
-		currentlyPlaying, err := getCurrentlyPlayingTrack()
+		currentlyPlaying, err := getCurrentlyPlayingTrack(channel)
 		if err != nil {
-			if currentlyPlaying.Playing {
-				c.String(http.StatusOK, "Currently playing on Spotify: %s by %s", currentlyPlaying.Item.Name, currentlyPlaying.Item.Artists[0].Name)
-			} else {
-				c.String(http.StatusOK, "No track currently playing.")
-			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to fetch currently playing track: %s", err)})
+			return
+		}
+
+		if currentlyPlaying.Playing {
+			c.String(http.StatusOK, "Currently playing on Spotify: %s by %s", currentlyPlaying.Item.Name, firstArtistName(currentlyPlaying.Item.Artists))
+		} else {
+			c.String(http.StatusOK, "No track currently playing.")
 		}
 	})
 
+	r.GET("/healthz", func(c *gin.Context) {
+		c.JSON(http.StatusOK, health.snapshot(twitchBroadcastChannel))
+	})
+
+	r.GET("/overlay", func(c *gin.Context) {
+		c.Header("Content-Type", "text/html")
+		c.String(http.StatusOK, overlayHTML)
+	})
+
+	r.GET("/overlay/events", func(c *gin.Context) {
+		channel := c.DefaultQuery("channel", twitchBroadcastChannel)
+		events, unsubscribe := overlayHubFor(channel).Subscribe()
+		defer unsubscribe()
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					return false
+				}
+				c.SSEvent("message", event)
+				return true
+			case <-c.Request.Context().Done():
+				return false
+			}
+		})
+	})
+
 	r.Run(":8080")
 }
 
-func getCurrentlyPlayingTrack() (*spotify.CurrentlyPlaying, error) {
-	spotifyClient.mu.Lock()
-	defer spotifyClient.mu.Unlock()
+// tokenStoreDir returns the directory Spotify tokens are encrypted and
+// written to, defaulting to ./data if TOKEN_STORE_DIR isn't set.
+func tokenStoreDir() string {
+	if dir := os.Getenv("TOKEN_STORE_DIR"); dir != "" {
+		return dir
+	}
+	return "./data"
+}
 
-	if spotifyClient.client == (spotify.Client{}) {
-		return nil, errors.New("spotify auth fail")
+// channelAuthCompleted reports whether channel has a Spotify token on file.
+func channelAuthCompleted(channel string) bool {
+	_, err := tokenStore.LoadToken(channel)
+	return err == nil
+}
+
+// getCurrentlyPlayingTrack fetches the track currently playing for channel's
+// Spotify account.
+func getCurrentlyPlayingTrack(channel string) (*spotify.CurrentlyPlaying, error) {
+	var currentlyPlaying *spotify.CurrentlyPlaying
+	err := withChannelSpotifyClient(channel, func(client *spotify.Client) error {
+		cp, err := client.PlayerCurrentlyPlaying()
+		if err != nil {
+			return err
+		}
+		currentlyPlaying = cp
+		return nil
+	})
+	if err == nil {
+		health.recordSpotifyPoll(time.Now())
 	}
+	return currentlyPlaying, err
+}
 
-	currentlyPlaying, err := spotifyClient.client.PlayerCurrentlyPlaying()
+// getUpcomingQueue returns up to limit tracks queued up next for channel's
+// Spotify account.
+func getUpcomingQueue(channel string, limit int) ([]spotify.FullTrack, error) {
+	var tracks []spotify.FullTrack
+	err := withChannelSpotifyClient(channel, func(client *spotify.Client) error {
+		queue, err := client.PlayerQueue()
+		if err != nil {
+			return err
+		}
+		tracks = queue.Queue
+		if len(tracks) > limit {
+			tracks = tracks[:limit]
+		}
+		return nil
+	})
+	return tracks, err
+}
+
+// withChannelSpotifyClient loads channel's token, builds a Spotify client
+// for it, runs fn, and persists the token back if the call refreshed it. The
+// whole sequence is serialized per channel: Spotify rotates refresh tokens
+// on every use, so two concurrent refreshes against the same stored refresh
+// token would leave one caller holding a token that's already been revoked.
+func withChannelSpotifyClient(channel string, fn func(*spotify.Client) error) error {
+	if remaining := spotifyRateLimiter.blockedFor(channel); remaining > 0 {
+		return fmt.Errorf("spotify rate limited for %s, try again in %s", channel, remaining.Round(time.Second))
+	}
+
+	unlock := locker.LockByKey("spotify:" + channel)
+	defer unlock()
+
+	client, storedToken, tokenSource, err := spotifyClientForChannel(channel)
 	if err != nil {
+		return err
+	}
+
+	fnErr := fn(client)
+
+	// Read the token back out of tokenSource, not just whatever we fetched
+	// before fn ran: the client's transport shares this TokenSource, so if a
+	// request inside fn triggered a refresh, this is the only place that
+	// rotated (single-use) refresh token is still observable.
+	if freshToken, tokenErr := tokenSource.Token(); tokenErr == nil && freshToken.AccessToken != storedToken.AccessToken {
+		if err := tokenStore.SaveToken(channel, freshToken); err != nil {
+			log.Printf("failed to persist refreshed spotify token for %s: %s", channel, err)
+		}
+	}
+
+	if fnErr != nil {
+		switch classifySpotifyError(fnErr) {
+		case SpotifyErrorUnauthorized:
+			if delErr := tokenStore.DeleteToken(channel); delErr != nil {
+				log.Printf("failed to clear spotify token for %s after 401: %s", channel, delErr)
+			}
+			return fmt.Errorf("spotify re-authentication required for %s: %w", channel, fnErr)
+		case SpotifyErrorRateLimited:
+			spotifyRateLimiter.backOff(channel, spotifyRateLimitBackoff)
+			return fmt.Errorf("spotify rate limited for %s, backing off %s: %w", channel, spotifyRateLimitBackoff, fnErr)
+		default:
+			return fnErr
+		}
+	}
+
+	return nil
+}
+
+// spotifyClientForChannel loads channel's stored token and returns a
+// spotify.Client backed by an oauth2.TokenSource derived from the Spotify
+// OAuth config, along with the token as stored and that same TokenSource.
+// The client's requests refresh the token through the TokenSource on demand,
+// so the caller must read the token back out of the TokenSource (rather than
+// assume it's whatever was fetched up front) to see any refresh that
+// happened during the call.
+func spotifyClientForChannel(channel string) (*spotify.Client, *oauth2.Token, oauth2.TokenSource, error) {
+	storedToken, err := tokenStore.LoadToken(channel)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	oauthConfig, err := spotifyOAuthConfig()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	tokenSource := oauthConfig.TokenSource(context.Background(), storedToken)
+	client := spotify.NewClient(oauth2.NewClient(context.Background(), tokenSource))
+	return &client, storedToken, tokenSource, nil
+}
+
+// checkSpotifyCredentials fails fast at startup if the Spotify app
+// credentials are missing, so a misconfiguration is caught before the HTTP
+// server starts instead of on the first Spotify call a live server makes.
+func checkSpotifyCredentials() {
+	if _, _, _, err := spotifyCredentials(); err != nil {
 		log.Fatal(err)
 	}
-	return currentlyPlaying, nil
 }
 
-func spotifyAuth() spotify.Authenticator {
-	clientID := os.Getenv("SPOTIFY_CLIENT_ID")         // Get from env or just paste here
-	clientSecret := os.Getenv("SPOTIFY_CLIENT_SECRET") // Get from env or just paste here
-	redirectURL := os.Getenv("SPOTIFY_REDIRECT_URI")   // Get from env or just paste here
+func spotifyCredentials() (clientID, clientSecret, redirectURL string, err error) {
+	clientID = os.Getenv("SPOTIFY_CLIENT_ID")         // Get from env or just paste here
+	clientSecret = os.Getenv("SPOTIFY_CLIENT_SECRET") // Get from env or just paste here
+	redirectURL = os.Getenv("SPOTIFY_REDIRECT_URI")   // Get from env or just paste here
 
 	if clientID == "" || clientSecret == "" {
-		log.Fatal("Missing Spotify Client ID or Client Secret. Set the SPOTIFY_CLIENT_ID and SPOTIFY_CLIENT_SECRET environment variables.")
+		return "", "", "", errors.New("missing Spotify Client ID or Client Secret. Set the SPOTIFY_CLIENT_ID and SPOTIFY_CLIENT_SECRET environment variables")
 	}
 
 	if redirectURL == "" {
 		redirectURL = spotifyRedirectURI
 	}
 
-	auth := spotify.NewAuthenticator(redirectURL, spotify.ScopeUserReadCurrentlyPlaying)
+	return clientID, clientSecret, redirectURL, nil
+}
+
+func spotifyAuth() (spotify.Authenticator, error) {
+	clientID, clientSecret, redirectURL, err := spotifyCredentials()
+	if err != nil {
+		return spotify.Authenticator{}, err
+	}
+
+	auth := spotify.NewAuthenticator(redirectURL,
+		spotify.ScopeUserReadCurrentlyPlaying,
+		spotify.ScopeUserReadPlaybackState,
+		spotify.ScopeUserModifyPlaybackState,
+	)
 	auth.SetAuthInfo(clientID, clientSecret)
 
-	return auth
+	return auth, nil
+}
+
+// spotifyOAuthConfig builds an oauth2.Config equivalent to the one backing
+// spotifyAuth(), so callers can derive a refreshing oauth2.TokenSource from
+// it directly. spotify.Authenticator doesn't expose its own oauth2.Config,
+// so this is kept in sync with spotifyAuth() by hand.
+func spotifyOAuthConfig() (*oauth2.Config, error) {
+	clientID, clientSecret, redirectURL, err := spotifyCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	return &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes: []string{
+			spotify.ScopeUserReadCurrentlyPlaying,
+			spotify.ScopeUserReadPlaybackState,
+			spotify.ScopeUserModifyPlaybackState,
+		},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  spotify.AuthURL,
+			TokenURL: spotify.TokenURL,
+		},
+	}, nil
 }
 
 func getTwitchAuthURL() string {
@@ -200,34 +429,86 @@ func getTwitchAccessToken(code string) (string, error) {
 	return tokenResp.AccessToken, nil
 }
 
-func handleTwitchMessages(oauthToken string) {
-	token := "oauth:" + oauthToken
-	client := twitch.NewClient(twitchBotUsername, token)
-	client.OnNewMessage(func(channel string, user twitch.User, message twitch.Message) {
-		if strings.HasPrefix(strings.ToLower(message.Text), "!sinnaybot song") {
-			track, err := getCurrentlyPlayingTrack()
-			if err == nil {
-				message := ""
-				if track.Item == nil {
-					message = fmt.Sprintf("@%s, no song currently playing", user.Username)
-				} else {
-					message = fmt.Sprintf("@%s, the song currently playing is %s by %s", user.Username, track.Item.Name, track.Item.Artists[0].Name)
-				}
+const (
+	twitchReconnectInitialBackoff = time.Second
+	twitchReconnectMaxBackoff     = 2 * time.Minute
+	// twitchReconnectResetAfter is how long a connection has to stay up
+	// before a later drop resets the backoff back to its initial value.
+	twitchReconnectResetAfter = time.Minute
+)
 
-				if message != "" {
-					client.Say(channel, message)
-				}
+// superviseTwitchBot keeps the Twitch IRC connection alive, reconnecting
+// with exponential backoff whenever client.Connect returns (on error or a
+// clean disconnect) instead of taking the whole process down with it.
+func superviseTwitchBot(oauthToken string) {
+	backoff := twitchReconnectInitialBackoff
 
-			}
+	for {
+		connectedAt := time.Now()
+		err := connectTwitchBot(oauthToken)
+		health.setTwitchConnected(false)
 
+		if time.Since(connectedAt) > twitchReconnectResetAfter {
+			backoff = twitchReconnectInitialBackoff
 		}
-	})
 
-	channel := twitchBroadcastChannel
-	client.Join(channel)
+		if err != nil {
+			log.Printf("twitch IRC connection dropped: %s (reconnecting in %s)", err, backoff)
+		} else {
+			log.Printf("twitch IRC disconnected (reconnecting in %s)", backoff)
+		}
 
-	err := client.Connect()
-	if err != nil {
-		log.Fatalf("Failed to connect to twitch IRC: %s", err)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > twitchReconnectMaxBackoff {
+			backoff = twitchReconnectMaxBackoff
+		}
+	}
+}
+
+// twitchBroadcastChannels returns every Twitch channel the bot should join.
+// TWITCH_BROADCAST_CHANNELS takes a comma-separated list, so the same bot
+// account can serve !song and friends for multiple broadcasters, each with
+// their own Spotify token in the token store. Falls back to the single
+// TWITCH_BROADCAST_CHANNEL for existing single-broadcaster setups.
+func twitchBroadcastChannels() []string {
+	raw := os.Getenv("TWITCH_BROADCAST_CHANNELS")
+	if raw == "" {
+		return []string{twitchBroadcastChannel}
+	}
+
+	var channels []string
+	for _, channel := range strings.Split(raw, ",") {
+		channel = strings.TrimSpace(channel)
+		if channel != "" {
+			channels = append(channels, channel)
+		}
 	}
+
+	if len(channels) == 0 {
+		return []string{twitchBroadcastChannel}
+	}
+
+	return channels
+}
+
+// connectTwitchBot makes a single connection attempt, joining every
+// configured broadcast channel and blocking until the connection drops or
+// fails.
+func connectTwitchBot(oauthToken string) error {
+	token := "oauth:" + oauthToken
+	client := twitch.NewClient(twitchBotUsername, token)
+	client.OnNewMessage(func(channel string, user twitch.User, message twitch.Message) {
+		dispatchCommand(client, channel, user, message.Text)
+	})
+	client.OnConnect(func() {
+		health.setTwitchConnected(true)
+	})
+
+	for _, channel := range twitchBroadcastChannels() {
+		client.Join(channel)
+	}
+
+	return client.Connect()
 }
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+// OverlayEvent is the SSE payload sent to "now playing" overlays (e.g. an
+// OBS browser source).
+type OverlayEvent struct {
+	Track      string `json:"track"`
+	Artist     string `json:"artist"`
+	Album      string `json:"album"`
+	ArtURL     string `json:"artUrl"`
+	ProgressMs int    `json:"progressMs"`
+	DurationMs int    `json:"durationMs"`
+	IsPlaying  bool   `json:"isPlaying"`
+}
+
+func overlayEventFromTrack(cp *spotify.CurrentlyPlaying) OverlayEvent {
+	if cp == nil || cp.Item == nil {
+		return OverlayEvent{}
+	}
+
+	var artURL string
+	if len(cp.Item.Album.Images) > 0 {
+		artURL = cp.Item.Album.Images[0].URL
+	}
+
+	return OverlayEvent{
+		Track:      cp.Item.Name,
+		Artist:     firstArtistName(cp.Item.Artists),
+		Album:      cp.Item.Album.Name,
+		ArtURL:     artURL,
+		ProgressMs: cp.Progress,
+		DurationMs: cp.Item.Duration,
+		IsPlaying:  cp.Playing,
+	}
+}
+
+// overlayHub polls Spotify for one channel on a fixed interval and fans the
+// resulting "now playing" state out to every connected SSE overlay, so N
+// overlays for the same channel share a single poll instead of each hitting
+// the Spotify API themselves.
+type overlayHub struct {
+	channel      string
+	pollInterval time.Duration
+
+	mu          sync.Mutex
+	subscribers map[chan OverlayEvent]struct{}
+	last        *OverlayEvent
+}
+
+func newOverlayHub(channel string, pollInterval time.Duration) *overlayHub {
+	return &overlayHub{
+		channel:      channel,
+		pollInterval: pollInterval,
+		subscribers:  make(map[chan OverlayEvent]struct{}),
+	}
+}
+
+// run polls on hub.pollInterval until the process exits, skipping the
+// Spotify call entirely while nobody is listening.
+func (h *overlayHub) run() {
+	ticker := time.NewTicker(h.pollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if h.subscriberCount() == 0 {
+			continue
+		}
+		h.poll()
+	}
+}
+
+func (h *overlayHub) subscriberCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers)
+}
+
+func (h *overlayHub) poll() {
+	cp, err := getCurrentlyPlayingTrack(h.channel)
+	if err != nil {
+		log.Printf("overlay poll failed for %s: %s", h.channel, err)
+		return
+	}
+
+	event := overlayEventFromTrack(cp)
+
+	h.mu.Lock()
+	unchanged := h.last != nil && *h.last == event
+	h.last = &event
+	h.mu.Unlock()
+
+	if !unchanged {
+		h.broadcast(event)
+	}
+}
+
+// Subscribe registers a new overlay listener, seeded with the last known
+// state if there is one, and returns an unsubscribe func the caller must run
+// when the connection closes.
+func (h *overlayHub) Subscribe() (<-chan OverlayEvent, func()) {
+	ch := make(chan OverlayEvent, 4)
+
+	h.mu.Lock()
+	h.subscribers[ch] = struct{}{}
+	last := h.last
+	h.mu.Unlock()
+
+	if last != nil {
+		ch <- *last
+	}
+
+	unsubscribe := func() {
+		h.mu.Lock()
+		delete(h.subscribers, ch)
+		h.mu.Unlock()
+	}
+
+	return ch, unsubscribe
+}
+
+func (h *overlayHub) broadcast(event OverlayEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// Subscriber isn't keeping up; drop the update rather than block the hub.
+		}
+	}
+}
+
+var overlayHubs = struct {
+	mu        sync.Mutex
+	byChannel map[string]*overlayHub
+}{byChannel: make(map[string]*overlayHub)}
+
+// overlayHubFor returns the shared overlayHub for channel, creating and
+// starting it on first use.
+func overlayHubFor(channel string) *overlayHub {
+	overlayHubs.mu.Lock()
+	defer overlayHubs.mu.Unlock()
+
+	hub, ok := overlayHubs.byChannel[channel]
+	if !ok {
+		hub = newOverlayHub(channel, overlayPollInterval())
+		overlayHubs.byChannel[channel] = hub
+		go hub.run()
+	}
+
+	return hub
+}
+
+func overlayPollInterval() time.Duration {
+	const defaultSeconds = 5
+
+	seconds := defaultSeconds
+	if v := os.Getenv("OVERLAY_POLL_INTERVAL_SECONDS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			seconds = n
+		}
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// overlayHTML is a minimal OBS browser-source page: it connects to
+// /overlay/events for its channel and renders album art, track, artist, and
+// a progress bar, updating whenever the hub pushes a new event.
+const overlayHTML = `<!DOCTYPE html>
+<html>
+	<head>
+		<title>Now Playing Overlay</title>
+		<style>
+			body { margin: 0; background: transparent; font-family: sans-serif; color: #fff; }
+			#overlay { display: flex; align-items: center; gap: 12px; padding: 12px; }
+			#art { width: 64px; height: 64px; border-radius: 4px; object-fit: cover; }
+			#meta { min-width: 0; }
+			#track { font-weight: bold; font-size: 16px; white-space: nowrap; overflow: hidden; text-overflow: ellipsis; }
+			#artist { font-size: 13px; opacity: 0.8; white-space: nowrap; overflow: hidden; text-overflow: ellipsis; }
+			#progress { width: 220px; height: 4px; background: rgba(255,255,255,0.25); border-radius: 2px; margin-top: 6px; }
+			#progress-fill { height: 100%; width: 0; background: #1db954; border-radius: 2px; }
+		</style>
+	</head>
+	<body>
+		<div id="overlay" style="display: none;">
+			<img id="art" src="" alt="">
+			<div id="meta">
+				<div id="track"></div>
+				<div id="artist"></div>
+				<div id="progress"><div id="progress-fill"></div></div>
+			</div>
+		</div>
+		<script>
+			var params = new URLSearchParams(window.location.search);
+			var channel = params.get("channel") || "";
+			var source = new EventSource("/overlay/events?channel=" + encodeURIComponent(channel));
+
+			source.addEventListener("message", function(e) {
+				var state = JSON.parse(e.data);
+				var overlay = document.getElementById("overlay");
+
+				if (!state.isPlaying) {
+					overlay.style.display = "none";
+					return;
+				}
+
+				overlay.style.display = "flex";
+				document.getElementById("art").src = state.artUrl;
+				document.getElementById("track").textContent = state.track;
+				document.getElementById("artist").textContent = state.artist;
+
+				var pct = state.durationMs > 0 ? (state.progressMs / state.durationMs) * 100 : 0;
+				document.getElementById("progress-fill").style.width = pct + "%";
+			});
+		</script>
+	</body>
+</html>`
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// spotifyRateLimitBackoff is how long we back off a channel after a 429.
+// zmb3/spotify's Client doesn't surface the underlying HTTP response, so we
+// can't read the real Retry-After header value here; this is a conservative
+// fixed stand-in for it.
+const spotifyRateLimitBackoff = 30 * time.Second
+
+// rateLimiter remembers, per channel, how long to stay away from the
+// Spotify API after a 429 so repeated commands don't hammer it while it's
+// already throttling us.
+type rateLimiter struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+var spotifyRateLimiter = &rateLimiter{until: make(map[string]time.Time)}
+
+// blockedFor reports how much longer channel is backed off for, or 0 if
+// it's clear to call Spotify again.
+func (r *rateLimiter) blockedFor(channel string) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	until, ok := r.until[channel]
+	if !ok {
+		return 0
+	}
+
+	remaining := time.Until(until)
+	if remaining <= 0 {
+		delete(r.until, channel)
+		return 0
+	}
+
+	return remaining
+}
+
+func (r *rateLimiter) backOff(channel string, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.until[channel] = time.Now().Add(d)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gempir/go-twitch-irc"
+	"github.com/zmb3/spotify"
+)
+
+// SongRequestConfig controls who may use !sr and what they're allowed to
+// queue. It's loaded once at startup from a JSON file so streamers can tune
+// it without a rebuild.
+type SongRequestConfig struct {
+	MaxQueueLength  int      `json:"max_queue_length"`
+	AllowedRoles    []string `json:"allowed_roles"` // e.g. "broadcaster", "moderator", "subscriber"
+	AllowedUsers    []string `json:"allowed_users"` // usernames, always allowed regardless of role
+	BlockedTrackIDs []string `json:"blocked_track_ids"`
+	BlockedArtists  []string `json:"blocked_artists"`
+}
+
+// defaultSongRequestConfig is used when no config file is present, so !sr
+// works out of the box with no per-streamer restrictions.
+func defaultSongRequestConfig() *SongRequestConfig {
+	return &SongRequestConfig{MaxQueueLength: 10}
+}
+
+func songRequestConfigPath() string {
+	if path := os.Getenv("SONG_REQUEST_CONFIG_PATH"); path != "" {
+		return path
+	}
+	return "./config/songrequest.json"
+}
+
+// LoadSongRequestConfig reads and parses the song request config at path.
+func LoadSongRequestConfig(path string) (*SongRequestConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg SongRequestConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing song request config: %w", err)
+	}
+
+	if cfg.MaxQueueLength == 0 {
+		cfg.MaxQueueLength = defaultSongRequestConfig().MaxQueueLength
+	}
+
+	return &cfg, nil
+}
+
+// songRequestConfig is the active config for !sr, set in main().
+var songRequestConfig = defaultSongRequestConfig()
+
+var trackURLPattern = regexp.MustCompile(`open\.spotify\.com/track/([a-zA-Z0-9]+)`)
+var trackURIPattern = regexp.MustCompile(`spotify:track:([a-zA-Z0-9]+)`)
+
+// parseTrackID extracts a track ID from a Spotify track URL or URI, and
+// reports whether query looked like one at all.
+func parseTrackID(query string) (spotify.ID, bool) {
+	if m := trackURLPattern.FindStringSubmatch(query); m != nil {
+		return spotify.ID(m[1]), true
+	}
+	if m := trackURIPattern.FindStringSubmatch(query); m != nil {
+		return spotify.ID(m[1]), true
+	}
+	return "", false
+}
+
+// resolveTrack turns a !sr argument into a concrete track, either by ID (if
+// query was a Spotify URL/URI) or by taking the top result of a search.
+func resolveTrack(client *spotify.Client, query string) (*spotify.FullTrack, error) {
+	if id, ok := parseTrackID(query); ok {
+		return client.GetTrack(id)
+	}
+
+	results, err := client.Search(query, spotify.SearchTypeTrack)
+	if err != nil {
+		return nil, err
+	}
+
+	if results.Tracks == nil || len(results.Tracks.Tracks) == 0 {
+		return nil, errors.New("no matching tracks")
+	}
+
+	return &results.Tracks.Tracks[0], nil
+}
+
+// songRequestAllowed reports whether user may use !sr under cfg. With no
+// allowlist configured, everyone is allowed.
+func songRequestAllowed(cfg *SongRequestConfig, user twitch.User) bool {
+	if len(cfg.AllowedRoles) == 0 && len(cfg.AllowedUsers) == 0 {
+		return true
+	}
+
+	for _, allowed := range cfg.AllowedUsers {
+		if strings.EqualFold(allowed, user.Username) {
+			return true
+		}
+	}
+
+	for _, role := range cfg.AllowedRoles {
+		if user.Badges[role] > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// songRequestBlocked reports whether track is on cfg's blocklist, by track
+// ID or by artist name.
+func songRequestBlocked(cfg *SongRequestConfig, track *spotify.FullTrack) bool {
+	for _, blocked := range cfg.BlockedTrackIDs {
+		if string(track.ID) == blocked {
+			return true
+		}
+	}
+
+	for _, artist := range track.Artists {
+		for _, blocked := range cfg.BlockedArtists {
+			if strings.EqualFold(artist.Name, blocked) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func handleSongRequestCommand(ctx *CommandContext) (string, error) {
+	cfg := songRequestConfig
+
+	if !songRequestAllowed(cfg, ctx.User) {
+		return fmt.Sprintf("@%s, you're not allowed to queue songs", ctx.User.Username), nil
+	}
+
+	query := strings.TrimSpace(ctx.Args)
+	if query == "" {
+		return fmt.Sprintf("@%s, usage: !sr <spotify url or search terms>", ctx.User.Username), nil
+	}
+
+	var reply string
+	err := withChannelSpotifyClient(ctx.Channel, func(client *spotify.Client) error {
+		queue, err := client.PlayerQueue()
+		if err != nil {
+			return err
+		}
+
+		if cfg.MaxQueueLength > 0 && len(queue.Queue) >= cfg.MaxQueueLength {
+			reply = fmt.Sprintf("@%s, the queue is full", ctx.User.Username)
+			return nil
+		}
+
+		track, err := resolveTrack(client, query)
+		if err != nil {
+			reply = fmt.Sprintf("@%s, couldn't find a track matching that", ctx.User.Username)
+			return nil
+		}
+
+		if songRequestBlocked(cfg, track) {
+			reply = fmt.Sprintf("@%s, that track can't be queued", ctx.User.Username)
+			return nil
+		}
+
+		if err := client.QueueSong(track.ID); err != nil {
+			return err
+		}
+
+		if len(track.Artists) > 0 {
+			reply = fmt.Sprintf("@%s, queued %s by %s", ctx.User.Username, track.Name, track.Artists[0].Name)
+		} else {
+			reply = fmt.Sprintf("@%s, queued %s", ctx.User.Username, track.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return reply, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/zmb3/spotify"
+)
+
+// SpotifyErrorKind buckets a Spotify API error by how a caller should react
+// to it, rather than making every call site inspect status codes itself.
+type SpotifyErrorKind int
+
+const (
+	SpotifyErrorOther SpotifyErrorKind = iota
+	// SpotifyErrorUnauthorized means the stored token is no longer valid
+	// and the channel needs to go through /spotify/login again.
+	SpotifyErrorUnauthorized
+	// SpotifyErrorRateLimited means we're being throttled and should back
+	// off before calling again.
+	SpotifyErrorRateLimited
+)
+
+// classifySpotifyError inspects err for a spotify.Error status code. Errors
+// that aren't spotify.Error (network failures, etc.) classify as
+// SpotifyErrorOther.
+func classifySpotifyError(err error) SpotifyErrorKind {
+	var spotifyErr spotify.Error
+	if !errors.As(err, &spotifyErr) {
+		return SpotifyErrorOther
+	}
+
+	switch spotifyErr.Status {
+	case http.StatusUnauthorized:
+		return SpotifyErrorUnauthorized
+	case http.StatusTooManyRequests:
+		return SpotifyErrorRateLimited
+	default:
+		return SpotifyErrorOther
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// TokenStore persists Spotify OAuth tokens per channel so the bot doesn't
+// need to be re-authenticated every time it restarts.
+type TokenStore interface {
+	LoadToken(channel string) (*oauth2.Token, error)
+	SaveToken(channel string, token *oauth2.Token) error
+	DeleteToken(channel string) error
+}
+
+// ErrTokenNotFound is returned by TokenStore.LoadToken when no token has
+// been saved yet for the given channel.
+var ErrTokenNotFound = errors.New("tokenstore: no token stored for channel")
+
+// fileTokenStore writes one AES-GCM encrypted file per channel under dir.
+// The encryption key comes from the TOKEN_ENCRYPTION_KEY env var (hex
+// encoded, must decode to 16, 24 or 32 bytes for AES-128/192/256).
+type fileTokenStore struct {
+	mu  sync.Mutex
+	dir string
+	key []byte
+}
+
+// NewFileTokenStore creates a TokenStore that writes encrypted token files
+// into dir, creating it if necessary.
+func NewFileTokenStore(dir string) (TokenStore, error) {
+	keyHex := os.Getenv("TOKEN_ENCRYPTION_KEY")
+	if keyHex == "" {
+		return nil, errors.New("TOKEN_ENCRYPTION_KEY is not set")
+	}
+
+	key, err := hex.DecodeString(keyHex)
+	if err != nil {
+		return nil, fmt.Errorf("TOKEN_ENCRYPTION_KEY is not valid hex: %w", err)
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating token store dir: %w", err)
+	}
+
+	return &fileTokenStore{dir: dir, key: key}, nil
+}
+
+// validChannelName matches the Twitch channel names this store accepts.
+// Twitch login names are themselves restricted to this character set, so
+// this also rejects path separators, "..", and anything else that could
+// escape dir when joined into a file path.
+var validChannelName = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+func (s *fileTokenStore) path(channel string) (string, error) {
+	if !validChannelName.MatchString(channel) {
+		return "", fmt.Errorf("invalid channel name %q", channel)
+	}
+	return filepath.Join(s.dir, channel+".token"), nil
+}
+
+func (s *fileTokenStore) LoadToken(channel string) (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path, err := s.path(channel)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrTokenNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := s.decrypt(ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting token for %s: %w", channel, err)
+	}
+
+	var token oauth2.Token
+	if err := json.Unmarshal(plaintext, &token); err != nil {
+		return nil, fmt.Errorf("unmarshalling token for %s: %w", channel, err)
+	}
+
+	return &token, nil
+}
+
+func (s *fileTokenStore) SaveToken(channel string, token *oauth2.Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path, err := s.path(channel)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("marshalling token for %s: %w", channel, err)
+	}
+
+	ciphertext, err := s.encrypt(plaintext)
+	if err != nil {
+		return fmt.Errorf("encrypting token for %s: %w", channel, err)
+	}
+
+	return ioutil.WriteFile(path, ciphertext, 0o600)
+}
+
+func (s *fileTokenStore) DeleteToken(channel string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path, err := s.path(channel)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *fileTokenStore) encrypt(plaintext []byte) ([]byte, error) {
+	gcm, err := s.gcm()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (s *fileTokenStore) decrypt(ciphertext []byte) ([]byte, error) {
+	gcm, err := s.gcm()
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := gcm.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, sealed := ciphertext[:nonceSize], ciphertext[nonceSize:]
+	return gcm.Open(nil, nonce, sealed, nil)
+}
+
+func (s *fileTokenStore) gcm() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}